@@ -1,6 +1,7 @@
 package pool
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
@@ -8,12 +9,26 @@ import (
 )
 
 type Config struct {
-	InitialCap  int                         //最小连接数
-	MaxCap      int                         //最大连接数
-	Factory     func() (interface{}, error) //生成连接方法
-	Close       func(interface{}) error     //关闭连接方法
-	Ping        func(interface{}) error     //检查连接是否有效的方法
-	IdleTimeout time.Duration               //连接最大空闲时间 超过该时间则将失效
+	InitialCap int //最小连接数
+	MaxCap     int //最大连接数
+	MaxIdle    int //最大空闲连接数,<=0表示不单独限制,与MaxCap保持一致
+
+	//ConnFactory优先于下面三个回调生效,是推荐的新写法;
+	//Addr是调用ConnFactory.Factory时使用的地址
+	ConnFactory ConnFactory
+	Addr        string
+
+	//Factory/Close/Ping是ConnFactory出现之前的写法,仅当ConnFactory为nil时使用,用于兼容旧代码
+	Factory func() (interface{}, error) //生成连接方法
+	Close   func(interface{}) error     //关闭连接方法
+	Ping    func(interface{}) error     //检查连接是否有效的方法
+
+	IdleTimeout time.Duration //连接最大空闲时间 超过该时间则将失效,<=0表示不启动空闲连接回收
+	WaitTimeout time.Duration //达到MaxCap后,Get()等待空闲连接的默认超时时间,<=0表示一直等待
+
+	//LeakDetect开启后,GetPooled/GetPooledContext返回的PooledConn在被垃圾回收时,
+	//如果还没有归还给连接池,会打印获取连接时的调用栈,用于排查忘记Close()的连接泄漏
+	LeakDetect bool
 }
 
 //存放连接信息
@@ -24,6 +39,18 @@ type channelPool struct {
 	close       func(interface{}) error
 	ping        func(interface{}) error
 	idleTimeout time.Duration
+	waitTimeout time.Duration
+
+	maxCap  int
+	maxIdle int
+	opened  int           //当前已经打开(空闲+使用中)的连接数
+	waiting int           //当前阻塞在GetContext里等待连接的数量
+	tokens  chan struct{} //剩余可以新开连接的配额,len(tokens)+opened<=maxCap
+
+	connFactory ConnFactory //配置了ConnFactory时保留,供MultiPool等上层按地址复用
+	leakDetect  bool
+
+	stopReaper chan struct{} //关闭空闲连接回收协程
 }
 
 type idleConn struct {
@@ -37,25 +64,51 @@ func NewChannelPool(config *Config) (Pool, error) {
 		return nil, errors.New("invalid capacity settings")
 	}
 
-	if config.Factory == nil {
+	if config.MaxIdle > config.MaxCap {
+		return nil, errors.New("invalid MaxIdle settings")
+	}
+
+	if config.ConnFactory == nil && config.Factory == nil {
 		return nil, errors.New("invalid factory func settings")
 	}
 
-	if config.Close == nil {
+	if config.ConnFactory == nil && config.Close == nil {
 		return nil, errors.New("invalid close func settings")
 	}
 
+	maxIdle := config.MaxIdle
+	if maxIdle <= 0 {
+		maxIdle = config.MaxCap
+	}
+
 	c := &channelPool{
 		conns:       make(chan *idleConn, config.MaxCap),
-		factory:     config.Factory,
-		close:       config.Close,
 		idleTimeout: config.IdleTimeout,
+		waitTimeout: config.WaitTimeout,
+		maxCap:      config.MaxCap,
+		maxIdle:     maxIdle,
+		tokens:      make(chan struct{}, config.MaxCap),
+		stopReaper:  make(chan struct{}),
+		leakDetect:  config.LeakDetect,
 	}
 
-	if config.Ping != nil {
+	if config.ConnFactory != nil {
+		addr := config.Addr
+		connFactory := config.ConnFactory
+		c.connFactory = connFactory
+		c.factory = func() (interface{}, error) { return connFactory.Factory(addr) }
+		c.close = connFactory.Close
+		c.ping = connFactory.Ping
+	} else {
+		c.factory = config.Factory
+		c.close = config.Close
 		c.ping = config.Ping
 	}
 
+	for i := 0; i < config.MaxCap-config.InitialCap; i++ {
+		c.tokens <- struct{}{}
+	}
+
 	for i := 0; i < config.InitialCap; i++ {
 		conn, err := c.factory()
 		if err != nil {
@@ -64,9 +117,67 @@ func NewChannelPool(config *Config) (Pool, error) {
 		}
 		c.conns <- &idleConn{conn: conn, t: time.Now()}
 	}
+	c.opened = config.InitialCap
+
+	if c.idleTimeout > 0 {
+		go c.reapLoop()
+	}
 	return c, nil
 }
 
+//reapLoop 定期扫描空闲连接,关闭已经超过IdleTimeout的连接
+func (c *channelPool) reapLoop() {
+	ticker := time.NewTicker(c.idleTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.reapIdleConns()
+		case <-c.stopReaper:
+			return
+		}
+	}
+}
+
+//reapIdleConns 扫描一遍当前空闲连接,关闭并丢弃已经过期的连接;
+//仍然存活的连接在同一次加锁内被放回,不会因为并发Put()抢占了刚腾出的槽位而被误判为池已满进而错误关闭
+func (c *channelPool) reapIdleConns() {
+	c.mu.Lock()
+	conns := c.conns
+	if conns == nil {
+		c.mu.Unlock()
+		return
+	}
+	n := len(conns)
+	c.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		c.mu.Lock()
+		if c.conns == nil {
+			c.mu.Unlock()
+			return
+		}
+
+		var wrapConn *idleConn
+		select {
+		case wrapConn = <-conns:
+		default:
+			c.mu.Unlock()
+			return
+		}
+
+		if wrapConn.t.Add(c.idleTimeout).Before(time.Now()) {
+			c.mu.Unlock()
+			c.Close(wrapConn.conn)
+			continue
+		}
+
+		//仍持有锁,Put()需要同一把锁才能往conns里塞连接,保证这次放回不会跟它抢同一个槽位
+		conns <- wrapConn
+		c.mu.Unlock()
+	}
+}
+
 //释放连接池
 func (c *channelPool) Release() {
 	c.mu.Lock()
@@ -76,7 +187,14 @@ func (c *channelPool) Release() {
 	c.ping = nil
 	closeFun := c.close
 	c.close = nil
+	c.opened = 0
+	c.tokens = nil
+	stopReaper := c.stopReaper
+	c.stopReaper = nil
 	c.mu.Unlock()
+	if stopReaper != nil {
+		close(stopReaper)
+	}
 	if conns == nil {
 		return
 	}
@@ -87,22 +205,36 @@ func (c *channelPool) Release() {
 
 }
 
+//Stats 返回连接池当前的打开/空闲/等待连接数量
+func (c *channelPool) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	idle := 0
+	if c.conns != nil {
+		idle = len(c.conns)
+	}
+	return Stats{Open: c.opened, Idle: idle, Waiting: c.waiting}
+}
+
 //获取连接数
 func (c *channelPool) Len() int {
 	return len(c.getConns())
 }
 
-//关闭连接
+//关闭连接,并释放其在连接池中占用的配额
 func (c *channelPool) Close(conn interface{}) error {
 	if conn == nil {
 		return errors.New("connection is nil,reject")
 	}
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.close == nil {
+	closeFun := c.close
+	c.mu.Unlock()
+	if closeFun == nil {
 		return nil
 	}
-	return c.close(conn)
+	err := closeFun(conn)
+	c.releaseOpened()
+	return err
 }
 
 //检查连接是否有效
@@ -121,6 +253,30 @@ func (c *channelPool) getConns() chan *idleConn {
 	return conns
 }
 
+//releaseOpened 代表一个已经打开的连接被真正关闭,归还其占用的配额
+func (c *channelPool) releaseOpened() {
+	c.mu.Lock()
+	if c.opened > 0 {
+		c.opened--
+	}
+	c.mu.Unlock()
+	c.returnToken()
+}
+
+//returnToken 归还一个新开连接的配额,用于配额被取走但连接最终未能建立的场景
+func (c *channelPool) returnToken() {
+	c.mu.Lock()
+	tokens := c.tokens
+	c.mu.Unlock()
+	if tokens == nil {
+		return
+	}
+	select {
+	case tokens <- struct{}{}:
+	default:
+	}
+}
+
 //新增连接
 func (c *channelPool) Put(conn interface{}) error {
 	if conn == nil {
@@ -131,6 +287,10 @@ func (c *channelPool) Put(conn interface{}) error {
 		c.mu.Unlock()
 		return c.Close(conn)
 	}
+	if len(c.conns) >= c.maxIdle {
+		c.mu.Unlock()
+		return c.Close(conn)
+	}
 	select {
 	case c.conns <- &idleConn{conn: conn, t: time.Now()}:
 		c.mu.Unlock()
@@ -141,44 +301,136 @@ func (c *channelPool) Put(conn interface{}) error {
 	}
 }
 
+//Get 获取一个连接,池为空且已达到MaxCap时按WaitTimeout阻塞等待
 func (c *channelPool) Get() (interface{}, error) {
-	conns := c.getConns()
-	if conns == nil {
-		return nil, ErrClosed
+	ctx := context.Background()
+	if c.waitTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.waitTimeout)
+		defer cancel()
+	}
+	return c.GetContext(ctx)
+}
+
+//GetPooled 与Get()类似,但返回的PooledConn实现io.Closer,defer conn.Close()即可归还给连接池
+func (c *channelPool) GetPooled() (*PooledConn, error) {
+	conn, err := c.Get()
+	if err != nil {
+		return nil, err
 	}
+	return newPooledConn(conn, c, c.leakDetect), nil
+}
+
+//GetPooledContext 与GetContext()类似,但返回的PooledConn实现io.Closer,defer conn.Close()即可归还给连接池
+func (c *channelPool) GetPooledContext(ctx context.Context) (*PooledConn, error) {
+	conn, err := c.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newPooledConn(conn, c, c.leakDetect), nil
+}
+
+//GetContext 获取一个连接,当池为空且已达到MaxCap时阻塞等待,直到ctx结束或者有连接被归还/配额被释放
+func (c *channelPool) GetContext(ctx context.Context) (interface{}, error) {
 	for {
-		select {
-		case wrapConn := <-conns:
-			if wrapConn == nil {
-				return nil, ErrClosed
-			}
+		c.mu.Lock()
+		conns := c.conns
+		tokens := c.tokens
+		c.mu.Unlock()
+		if conns == nil {
+			return nil, ErrClosed
+		}
 
-			if timeout := c.idleTimeout; timeout > 0 {
-				if wrapConn.t.Add(timeout).Before(time.Now()) {
-					c.Close(wrapConn.conn)
-					continue
-				}
+		//先非阻塞地尝试一次;只有确实没有空闲连接也没有配额可用时,才计入waiting并真正阻塞,
+		//这样Stats().Waiting只反映真正被MaxCap/池为空卡住的调用方,而不是所有在途的Get调用。
+		//conns和tokens分两个select单独尝试,优先复用空闲连接,避免两者同时就绪时被select随机
+		//选中tokens而去新开一个连接,导致opened无谓增长、原本温热的空闲连接反而被晾成陈旧连接
+		select {
+		case wrapConn, ok := <-conns:
+			conn, retry, err := c.acquireIdle(wrapConn, ok)
+			if retry {
+				continue
 			}
+			return conn, err
+		default:
+		}
 
-			if c.ping != nil {
-				if err := c.Ping(wrapConn.conn); err != nil {
-					fmt.Println("conn is not able to be connected:", err)
-					continue
-				}
-			}
-			return wrapConn.conn, nil
+		select {
+		case <-tokens:
+			return c.openNew()
 		default:
-			c.mu.Lock()
-			if c.factory == nil {
-				c.mu.Unlock()
-				continue
-			}
-			conn, err := c.factory()
-			c.mu.Unlock()
-			if err != nil {
-				return nil, err
-			}
-			return conn, nil
+		}
+
+		c.mu.Lock()
+		c.waiting++
+		c.mu.Unlock()
+		conn, retry, err := c.waitForConn(ctx, conns, tokens)
+		c.mu.Lock()
+		c.waiting--
+		c.mu.Unlock()
+		if retry {
+			continue
+		}
+		return conn, err
+	}
+}
+
+//waitForConn 真正阻塞等待空闲连接/新开连接的配额,或者ctx结束
+func (c *channelPool) waitForConn(ctx context.Context, conns chan *idleConn, tokens chan struct{}) (interface{}, bool, error) {
+	select {
+	case wrapConn, ok := <-conns:
+		return c.acquireIdle(wrapConn, ok)
+	case <-tokens:
+		conn, err := c.openNew()
+		return conn, false, err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, false, ErrWaitTimeout
+		}
+		return nil, false, ctx.Err()
+	}
+}
+
+//acquireIdle 校验从conns取出的空闲连接是否仍然可用;retry为true表示连接已失效,外层应该重试
+func (c *channelPool) acquireIdle(wrapConn *idleConn, ok bool) (interface{}, bool, error) {
+	if !ok || wrapConn == nil {
+		return nil, false, ErrClosed
+	}
+
+	if timeout := c.idleTimeout; timeout > 0 {
+		if wrapConn.t.Add(timeout).Before(time.Now()) {
+			c.Close(wrapConn.conn)
+			return nil, true, nil
+		}
+	}
+
+	if c.ping != nil {
+		if err := c.Ping(wrapConn.conn); err != nil {
+			fmt.Println("conn is not able to be connected:", err)
+			c.Close(wrapConn.conn)
+			return nil, true, nil
 		}
 	}
+	return wrapConn.conn, false, nil
+}
+
+//openNew 消费掉一个token后新建一个连接;factory必须在持锁状态下读取,避免与Release()并发置nil时发生数据竞争
+func (c *channelPool) openNew() (interface{}, error) {
+	c.mu.Lock()
+	factory := c.factory
+	c.mu.Unlock()
+	if factory == nil {
+		c.returnToken()
+		return nil, ErrClosed
+	}
+
+	conn, err := factory()
+	if err != nil {
+		c.returnToken()
+		return nil, err
+	}
+	c.mu.Lock()
+	c.opened++
+	c.mu.Unlock()
+	return conn, nil
 }
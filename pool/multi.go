@@ -0,0 +1,415 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//RoutingPolicy 决定MultiPool.Get()在多个endpoint之间如何选择
+type RoutingPolicy int
+
+const (
+	RoundRobin      RoutingPolicy = iota //轮询
+	LeastLoaded                          //优先选择当前使用中连接数最少的endpoint
+	ConsistentHash                       //按GetFor传入的key做一致性哈希,相同key固定落到同一个endpoint
+)
+
+var (
+	ErrNoHealthyEndpoint = errors.New("pool: no healthy endpoint available")
+	ErrUnknownEndpoint   = errors.New("pool: unknown endpoint")
+)
+
+//健康探测失败后的指数退避区间
+const (
+	minEjectBackoff = time.Second
+	maxEjectBackoff = time.Minute
+)
+
+//连续多少次获取连接失败(如建立连接出错)后才摘除一个endpoint,避免瞬时抖动或池被打满导致误摘除;
+//子连接池内部Ping失败的空闲连接会被直接关闭并重试,不计入失败次数
+const ejectThreshold = 3
+
+//defaultProbeTimeout 是单次候选endpoint尝试获取连接的默认超时时间,
+//当template.WaitTimeout<=0(即子连接池默认无限等待)时生效,确保Get/GetFor总能按策略回退到下一个endpoint
+const defaultProbeTimeout = 3 * time.Second
+
+const virtualNodesPerEndpoint = 100
+
+//Conn 是MultiPool.Get()/GetFor()返回的连接,记录了其所属的endpoint地址;
+//Put/Close时需要把同一个Conn原样传回,以便归还到正确的子连接池
+type Conn struct {
+	Addr string
+	Conn interface{}
+}
+
+//endpoint 是MultiPool内部对单个后端地址的封装,持有一个普通的channelPool
+type endpoint struct {
+	addr  string
+	pool  Pool
+	inUse int64 //原子计数,当前使用中的连接数,供LeastLoaded策略参考
+
+	mu           sync.Mutex
+	failCount    int
+	ejectedUntil time.Time //非零值表示该endpoint被临时摘除,在这个时间之前不参与路由
+
+	draining int32 //原子标记,RemoveEndpoint()之后为1;此时不再路由新请求,但仍接受在途连接的Put/Close
+}
+
+func (e *endpoint) healthy(now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.ejectedUntil.IsZero() || !e.ejectedUntil.After(now)
+}
+
+func (e *endpoint) recordSuccess() {
+	e.mu.Lock()
+	e.failCount = 0
+	e.ejectedUntil = time.Time{}
+	e.mu.Unlock()
+}
+
+//recordFailure 记录一次获取连接失败(ErrWaitTimeout/ErrClosed以外的错误);只有连续达到ejectThreshold次才会被摘除,
+//之后摘除时间按指数退避增长,直到封顶maxEjectBackoff
+func (e *endpoint) recordFailure() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failCount++
+	if e.failCount < ejectThreshold {
+		return
+	}
+	backoff := minEjectBackoff << uint(e.failCount-ejectThreshold)
+	if backoff <= 0 || backoff > maxEjectBackoff {
+		backoff = maxEjectBackoff
+	}
+	e.ejectedUntil = time.Now().Add(backoff)
+}
+
+//MultiPool 在多个后端地址上各维护一个channelPool子连接池,并按RoutingPolicy路由Get()请求,
+//可以当作gRPC/TCP/Redis等场景下的客户端负载均衡使用
+type MultiPool struct {
+	mu        sync.RWMutex
+	policy    RoutingPolicy
+	template  Config //子连接池的基础配置,ConnFactory/Addr以外的字段对所有endpoint生效
+	endpoints map[string]*endpoint
+	order     []string //稳定顺序,供RoundRobin/一致性哈希回退使用
+	rrCursor  uint64
+
+	//attemptTimeout是每个候选endpoint一次Get尝试的超时时间,
+	//取template.WaitTimeout(>0时),否则用defaultProbeTimeout兜底,
+	//保证即使子连接池配置为无限等待,候选endpoint不健康或打满时也能按策略回退到下一个
+	attemptTimeout time.Duration
+
+	ring hashRing
+}
+
+//NewMultiPool 创建一个多endpoint连接池,addrs是初始的后端地址列表,template.Addr会被忽略并按endpoint覆盖
+func NewMultiPool(policy RoutingPolicy, template Config, addrs []string) (*MultiPool, error) {
+	attemptTimeout := template.WaitTimeout
+	if attemptTimeout <= 0 {
+		attemptTimeout = defaultProbeTimeout
+	}
+	m := &MultiPool{
+		policy:         policy,
+		template:       template,
+		endpoints:      make(map[string]*endpoint),
+		attemptTimeout: attemptTimeout,
+	}
+	for _, addr := range addrs {
+		if err := m.AddEndpoint(addr); err != nil {
+			m.Release()
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+//AddEndpoint 给连接池新增一个后端地址,可以在运行时动态调用而不需要清空整个连接池;
+//对已经存在的地址重复调用是no-op
+func (m *MultiPool) AddEndpoint(addr string) error {
+	m.mu.RLock()
+	_, exists := m.endpoints[addr]
+	m.mu.RUnlock()
+	if exists {
+		return nil
+	}
+
+	cfg := m.template
+	cfg.Addr = addr
+	p, err := NewChannelPool(&cfg)
+	if err != nil {
+		return fmt.Errorf("multipool: add endpoint %s: %w", addr, err)
+	}
+
+	m.mu.Lock()
+	if _, exists := m.endpoints[addr]; exists {
+		m.mu.Unlock()
+		p.Release()
+		return nil
+	}
+	m.endpoints[addr] = &endpoint{addr: addr, pool: p}
+	m.order = append(m.order, addr)
+	m.ring = buildHashRing(m.order)
+	m.mu.Unlock()
+	return nil
+}
+
+//RemoveEndpoint 把一个后端地址从连接池中摘除,不再参与后续路由;
+//但在它上面还有连接在途时(inUse>0)不会立即释放子连接池,避免调用方归还/关闭这些连接时
+//因为endpoint已经消失而被当作ErrUnknownEndpoint丢弃,导致底层fd泄漏。
+//实际的释放被推迟到这些连接都通过Put/Close归还之后,由maybeReleaseDrained完成
+func (m *MultiPool) RemoveEndpoint(addr string) error {
+	m.mu.Lock()
+	ep, ok := m.endpoints[addr]
+	if !ok {
+		m.mu.Unlock()
+		return ErrUnknownEndpoint
+	}
+	for i, a := range m.order {
+		if a == addr {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			break
+		}
+	}
+	m.ring = buildHashRing(m.order)
+	m.mu.Unlock()
+
+	atomic.StoreInt32(&ep.draining, 1)
+	m.maybeReleaseDrained(addr, ep)
+	return nil
+}
+
+//maybeReleaseDrained 在endpoint已经被标记为draining且不再有在途连接时,
+//把它从endpoints中摘除并释放子连接池;在此之前Put/Close仍然需要endpointFor能找到它
+func (m *MultiPool) maybeReleaseDrained(addr string, ep *endpoint) {
+	if atomic.LoadInt32(&ep.draining) == 0 || atomic.LoadInt64(&ep.inUse) != 0 {
+		return
+	}
+
+	m.mu.Lock()
+	if m.endpoints[addr] != ep {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.endpoints, addr)
+	m.mu.Unlock()
+
+	ep.pool.Release()
+}
+
+//Get 按配置的RoutingPolicy从健康的endpoint中选一个获取连接
+func (m *MultiPool) Get() (*Conn, error) {
+	return m.getWithKey("")
+}
+
+//GetFor 按一致性哈希用key选择endpoint获取连接;策略不是ConsistentHash时退化为Get()的行为
+func (m *MultiPool) GetFor(key string) (*Conn, error) {
+	return m.getWithKey(key)
+}
+
+func (m *MultiPool) getWithKey(key string) (*Conn, error) {
+	order := m.candidates(key)
+	if len(order) == 0 {
+		return nil, ErrNoHealthyEndpoint
+	}
+
+	now := time.Now()
+	var lastErr error
+	for _, addr := range order {
+		m.mu.RLock()
+		ep := m.endpoints[addr]
+		m.mu.RUnlock()
+		if ep == nil || !ep.healthy(now) {
+			continue
+		}
+
+		conn, err := m.attemptGet(ep)
+		if err != nil {
+			//ErrWaitTimeout(池被打满)和ErrClosed(本地状态)不代表endpoint不健康,不计入失败次数,
+			//否则一个繁忙但正常的endpoint会在负载下被误摘除,反而放大故障
+			if !errors.Is(err, ErrWaitTimeout) && !errors.Is(err, ErrClosed) {
+				ep.recordFailure()
+			}
+			lastErr = err
+			continue
+		}
+		ep.recordSuccess()
+		atomic.AddInt64(&ep.inUse, 1)
+		return &Conn{Addr: addr, Conn: conn}, nil
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, ErrNoHealthyEndpoint
+}
+
+//attemptGet 给单个endpoint一次有界的Get尝试,即使该endpoint的子连接池本身配置为无限等待(WaitTimeout<=0),
+//也能在attemptTimeout后放弃并让调用方按策略回退到下一个endpoint
+func (m *MultiPool) attemptGet(ep *endpoint) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.attemptTimeout)
+	defer cancel()
+	return ep.pool.GetContext(ctx)
+}
+
+//candidates 按当前策略返回一组待尝试的endpoint地址,列表按尝试的先后顺序排列,
+//用于在挑选出的endpoint不健康或Get()失败时按顺序回退到下一个
+func (m *MultiPool) candidates(key string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if len(m.order) == 0 {
+		return nil
+	}
+
+	switch m.policy {
+	case LeastLoaded:
+		order := append([]string(nil), m.order...)
+		sort.Slice(order, func(i, j int) bool {
+			return atomic.LoadInt64(&m.endpoints[order[i]].inUse) < atomic.LoadInt64(&m.endpoints[order[j]].inUse)
+		})
+		return order
+	case ConsistentHash:
+		return m.ring.ownersFrom(key)
+	default: // RoundRobin
+		start := int(atomic.AddUint64(&m.rrCursor, 1)-1) % len(m.order)
+		return rotate(m.order, start)
+	}
+}
+
+//Put 把连接归还给它所属的endpoint子连接池;如果该endpoint已经被RemoveEndpoint摘除(draining),
+//则不再放回池中复用,而是直接关闭,并在这是最后一个在途连接时触发子连接池的真正释放
+func (m *MultiPool) Put(c *Conn) error {
+	if c == nil {
+		return errors.New("connection is nil,reject")
+	}
+	ep, err := m.endpointFor(c.Addr)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&ep.inUse, -1)
+	if atomic.LoadInt32(&ep.draining) != 0 {
+		err = ep.pool.Close(c.Conn)
+		m.maybeReleaseDrained(c.Addr, ep)
+		return err
+	}
+	return ep.pool.Put(c.Conn)
+}
+
+//Close 关闭连接,并释放它在所属endpoint上占用的配额;
+//如果该endpoint正在draining且这是最后一个在途连接,顺带触发子连接池的真正释放
+func (m *MultiPool) Close(c *Conn) error {
+	if c == nil {
+		return errors.New("connection is nil,reject")
+	}
+	ep, err := m.endpointFor(c.Addr)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&ep.inUse, -1)
+	err = ep.pool.Close(c.Conn)
+	if atomic.LoadInt32(&ep.draining) != 0 {
+		m.maybeReleaseDrained(c.Addr, ep)
+	}
+	return err
+}
+
+func (m *MultiPool) endpointFor(addr string) (*endpoint, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ep, ok := m.endpoints[addr]
+	if !ok {
+		return nil, ErrUnknownEndpoint
+	}
+	return ep, nil
+}
+
+//Release 释放所有endpoint的子连接池
+func (m *MultiPool) Release() {
+	m.mu.Lock()
+	endpoints := m.endpoints
+	m.endpoints = make(map[string]*endpoint)
+	m.order = nil
+	m.mu.Unlock()
+	for _, ep := range endpoints {
+		ep.pool.Release()
+	}
+}
+
+func rotate(addrs []string, start int) []string {
+	n := len(addrs)
+	out := make([]string, n)
+	for i := 0; i < n; i++ {
+		out[i] = addrs[(start+i)%n]
+	}
+	return out
+}
+
+//hashRing 是一个简单的一致性哈希环,每个endpoint分配固定数量的虚拟节点以均匀散列
+type hashRing struct {
+	points []uint32 //按升序排列
+	addrs  []string //与points一一对应
+}
+
+func buildHashRing(addrs []string) hashRing {
+	var points []uint32
+	var owners []string
+	for _, addr := range addrs {
+		for i := 0; i < virtualNodesPerEndpoint; i++ {
+			points = append(points, crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s#%d", addr, i))))
+			owners = append(owners, addr)
+		}
+	}
+
+	idx := make([]int, len(points))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(i, j int) bool { return points[idx[i]] < points[idx[j]] })
+
+	ring := hashRing{points: make([]uint32, len(idx)), addrs: make([]string, len(idx))}
+	for i, id := range idx {
+		ring.points[i] = points[id]
+		ring.addrs[i] = owners[id]
+	}
+	return ring
+}
+
+//addrFor 返回key在哈希环上顺时针碰到的第一个endpoint地址,环为空时返回空字符串
+func (r hashRing) addrFor(key string) string {
+	owners := r.ownersFrom(key)
+	if len(owners) == 0 {
+		return ""
+	}
+	return owners[0]
+}
+
+//ownersFrom 从key在哈希环上顺时针碰到的第一个虚拟节点开始,按环上顺序收集所有不重复的endpoint地址;
+//用作ConsistentHash策略的候选顺序,保证某个endpoint被摘除时,其key只会顺时针漂移到环上最近的下一个
+//endpoint,而不是退化成其它地址的插入顺序,从而维持一致性哈希"最小重映射"的特性
+func (r hashRing) ownersFrom(key string) []string {
+	if len(r.points) == 0 {
+		return nil
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if start == len(r.points) {
+		start = 0
+	}
+
+	seen := make(map[string]bool, len(r.addrs))
+	owners := make([]string, 0, len(r.addrs))
+	for i := 0; i < len(r.points); i++ {
+		addr := r.addrs[(start+i)%len(r.points)]
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		owners = append(owners, addr)
+	}
+	return owners
+}
@@ -1,15 +1,28 @@
 package pool
 
-import "errors"
+import (
+	"context"
+	"errors"
+)
 
 var (
 	ErrClosed = errors.New("pool is closed")
+	//等待空闲连接超时
+	ErrWaitTimeout = errors.New("pool get connection timeout")
 )
 
 //线程池接口
 type Pool interface {
 	Get() (interface{}, error)
 
+	//带上下文的获取连接,在达到MaxCap后会阻塞等待,直到ctx被取消/超时或者有连接被归还
+	GetContext(ctx context.Context) (interface{}, error)
+
+	//GetPooled/GetPooledContext与Get/GetContext类似,但返回的PooledConn实现io.Closer,
+	//调用方可以直接defer conn.Close()把连接归还给连接池,不需要自己调用Put()
+	GetPooled() (*PooledConn, error)
+	GetPooledContext(ctx context.Context) (*PooledConn, error)
+
 	Put(interface{}) error
 
 	Close(interface{}) error
@@ -17,4 +30,22 @@ type Pool interface {
 	Release()
 
 	Len() int
+
+	//Stats 返回连接池当前的打开/空闲/等待连接的调用方数量
+	Stats() Stats
+}
+
+//连接池运行状态
+type Stats struct {
+	Open    int //当前已打开的连接数(空闲+使用中)
+	Idle    int //当前空闲连接数
+	Waiting int //当前阻塞在Get/GetContext上等待连接的数量
+}
+
+//ConnFactory 是Config.Factory/Close/Ping三个回调的接口化版本,
+//Factory按地址建立连接,使同一个ConnFactory可以服务多个地址(见MultiPool)
+type ConnFactory interface {
+	Factory(addr string) (interface{}, error)
+	Close(conn interface{}) error
+	Ping(conn interface{}) error
 }
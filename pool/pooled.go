@@ -0,0 +1,140 @@
+package pool
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	//ErrAlreadyReturned 在Close()被重复调用,或者连接已经归还后还被继续使用时返回
+	ErrAlreadyReturned = errors.New("pool: connection already closed or returned")
+	//ErrNotNetConn 在底层连接不是net.Conn却调用了net.Conn方法时返回
+	ErrNotNetConn = errors.New("pool: underlying connection is not a net.Conn")
+)
+
+//PooledConn 包装一个从连接池取出的连接,实现io.Closer。
+//调用Close()时,如果没有被MarkBroken()标记过,会把连接通过Put()归还给连接池,
+//而不是真正关闭它,这样调用方可以像用database/sql那样简单地defer conn.Close()。
+//当底层连接本身是net.Conn时,PooledConn也实现了net.Conn,可以直接替换使用。
+type PooledConn struct {
+	conn interface{}
+	pool Pool
+
+	broken int32 //原子标记,MarkBroken()之后为1
+	done   int32 //原子标记,Close()已经被调用并生效过
+}
+
+//newPooledConn 构造一个PooledConn;leakDetect为true时会挂上finalizer,
+//在垃圾回收时如果连接还没有被归还就打印当时获取连接的调用栈
+func newPooledConn(conn interface{}, pool Pool, leakDetect bool) *PooledConn {
+	pc := &PooledConn{conn: conn, pool: pool}
+	if leakDetect {
+		stack := debug.Stack()
+		runtime.SetFinalizer(pc, func(pc *PooledConn) {
+			if atomic.LoadInt32(&pc.done) == 0 {
+				fmt.Printf("pool: PooledConn leaked, acquired at:\n%s\n", stack)
+			}
+		})
+	}
+	return pc
+}
+
+//Conn 返回被包装的原始连接,在Close()之后调用会触发use-after-return告警但仍然返回原值
+func (pc *PooledConn) Conn() interface{} {
+	if atomic.LoadInt32(&pc.done) != 0 {
+		fmt.Println("pool: use of PooledConn after it was closed/returned")
+	}
+	return pc.conn
+}
+
+//MarkBroken 标记这个连接已经损坏,Close()时会真正关闭它而不是放回连接池
+func (pc *PooledConn) MarkBroken() {
+	atomic.StoreInt32(&pc.broken, 1)
+}
+
+//Close 实现io.Closer。重复调用,或者在连接已经归还后再次调用,都返回ErrAlreadyReturned
+func (pc *PooledConn) Close() error {
+	if !atomic.CompareAndSwapInt32(&pc.done, 0, 1) {
+		return ErrAlreadyReturned
+	}
+	runtime.SetFinalizer(pc, nil)
+
+	if atomic.LoadInt32(&pc.broken) != 0 {
+		return pc.pool.Close(pc.conn)
+	}
+	return pc.pool.Put(pc.conn)
+}
+
+func (pc *PooledConn) netConn() (net.Conn, error) {
+	if atomic.LoadInt32(&pc.done) != 0 {
+		return nil, ErrAlreadyReturned
+	}
+	nc, ok := pc.conn.(net.Conn)
+	if !ok {
+		return nil, ErrNotNetConn
+	}
+	return nc, nil
+}
+
+//Read 在底层连接是net.Conn时转发读取,否则返回ErrNotNetConn
+func (pc *PooledConn) Read(b []byte) (int, error) {
+	nc, err := pc.netConn()
+	if err != nil {
+		return 0, err
+	}
+	return nc.Read(b)
+}
+
+//Write 在底层连接是net.Conn时转发写入,否则返回ErrNotNetConn
+func (pc *PooledConn) Write(b []byte) (int, error) {
+	nc, err := pc.netConn()
+	if err != nil {
+		return 0, err
+	}
+	return nc.Write(b)
+}
+
+func (pc *PooledConn) LocalAddr() net.Addr {
+	nc, err := pc.netConn()
+	if err != nil {
+		return nil
+	}
+	return nc.LocalAddr()
+}
+
+func (pc *PooledConn) RemoteAddr() net.Addr {
+	nc, err := pc.netConn()
+	if err != nil {
+		return nil
+	}
+	return nc.RemoteAddr()
+}
+
+func (pc *PooledConn) SetDeadline(t time.Time) error {
+	nc, err := pc.netConn()
+	if err != nil {
+		return err
+	}
+	return nc.SetDeadline(t)
+}
+
+func (pc *PooledConn) SetReadDeadline(t time.Time) error {
+	nc, err := pc.netConn()
+	if err != nil {
+		return err
+	}
+	return nc.SetReadDeadline(t)
+}
+
+func (pc *PooledConn) SetWriteDeadline(t time.Time) error {
+	nc, err := pc.netConn()
+	if err != nil {
+		return err
+	}
+	return nc.SetWriteDeadline(t)
+}
@@ -0,0 +1,38 @@
+package pool
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+//TCPConnFactory 是开箱即用的ConnFactory实现,用net.DialTimeout按地址建立TCP连接
+type TCPConnFactory struct {
+	DialTimeout time.Duration //单次拨号超时时间,<=0表示使用net.Dial不设超时
+}
+
+//Factory 按地址拨号建立一个TCP连接
+func (f *TCPConnFactory) Factory(addr string) (interface{}, error) {
+	if f.DialTimeout <= 0 {
+		return net.Dial("tcp", addr)
+	}
+	return net.DialTimeout("tcp", addr, f.DialTimeout)
+}
+
+//Close 关闭一个TCP连接
+func (f *TCPConnFactory) Close(conn interface{}) error {
+	c, ok := conn.(net.Conn)
+	if !ok {
+		return errors.New("tcpConnFactory: conn is not a net.Conn")
+	}
+	return c.Close()
+}
+
+//Ping 只检查conn是否为net.Conn,不对连接做实际的网络存活探测
+func (f *TCPConnFactory) Ping(conn interface{}) error {
+	_, ok := conn.(net.Conn)
+	if !ok {
+		return errors.New("tcpConnFactory: conn is not a net.Conn")
+	}
+	return nil
+}